@@ -22,29 +22,132 @@ import (
 	"github.com/pyroscope-io/jfr-parser/parser"
 )
 
+// EventFamily identifies a group of JFR events that get converted into one
+// or more pprof sample types.
+type EventFamily int
+
+const (
+	// EventFamilyCPU covers jdk.ExecutionSample, i.e. on-CPU samples.
+	EventFamilyCPU EventFamily = iota
+	// EventFamilyOffCPU covers jdk.ThreadPark, jdk.JavaMonitorWait and
+	// jdk.ThreadSleep, i.e. time spent blocked off-CPU.
+	EventFamilyOffCPU
+	// EventFamilyAllocation covers jdk.ObjectAllocationInNewTLAB and
+	// jdk.ObjectAllocationOutsideTLAB.
+	EventFamilyAllocation
+	// EventFamilyWall covers jdk.NativeMethodSample, i.e. wall-clock
+	// samples taken regardless of thread state.
+	EventFamilyWall
+)
+
+// sampleType describes a pprof sample type produced for an EventFamily.
+type sampleType struct {
+	family    EventFamily
+	valueType *profile.ValueType
+}
+
+var sampleTypesByFamily = map[EventFamily][]sampleType{
+	EventFamilyCPU: {
+		{EventFamilyCPU, &profile.ValueType{Type: "cpu", Unit: "samples"}},
+	},
+	EventFamilyOffCPU: {
+		{EventFamilyOffCPU, &profile.ValueType{Type: "off_cpu", Unit: "nanoseconds"}},
+	},
+	EventFamilyAllocation: {
+		{EventFamilyAllocation, &profile.ValueType{Type: "alloc_space", Unit: "bytes"}},
+		{EventFamilyAllocation, &profile.ValueType{Type: "alloc_objects", Unit: "count"}},
+	},
+	EventFamilyWall: {
+		{EventFamilyWall, &profile.ValueType{Type: "wall", Unit: "samples"}},
+	},
+}
+
+// Symbolizer resolves an absolute program counter, sampled from a native or
+// JIT-compiled frame of the given process, to a function name and source
+// line. Implementations are expected to wrap the agent's own DWARF/ELF
+// symbolizer and process/PID map.
+type Symbolizer interface {
+	Symbolize(pid int, pc uint64) (function string, line int64, ok bool)
+}
+
+// JfrToPprofOptions controls which JFR event families JfrToPprof converts
+// into the resulting pprof profile. The zero value (a nil EventFamilies)
+// converts only on-CPU samples, matching the historical behaviour of
+// JfrToPprof. To convert no event families at all, pass a non-nil empty
+// slice explicitly.
+type JfrToPprofOptions struct {
+	EventFamilies []EventFamily
+
+	// PID is the process id the JFR recording was captured from. It's
+	// passed to Symbolizer to resolve native/JIT frame addresses.
+	PID int
+	// Symbolizer resolves native/JIT frames to a function name and line.
+	// Native/JIT frames are kept under their raw, unsymbolized name when
+	// Symbolizer is nil.
+	Symbolizer Symbolizer
+}
+
+// DefaultJfrToPprofOptions converts only on-CPU samples.
+func DefaultJfrToPprofOptions() JfrToPprofOptions {
+	return JfrToPprofOptions{EventFamilies: []EventFamily{EventFamilyCPU}}
+}
+
 type builder struct {
-	profile       *profile.Profile
+	profile *profile.Profile
+
+	// valueIndex maps an EventFamily to the index (or, for allocations,
+	// the first of two consecutive indices) into profile.Sample.Value
+	// and profile.SampleType that the family writes to.
+	valueIndex map[EventFamily]int
+
+	pid        int
+	symbolizer Symbolizer
+
 	locationTable map[string]*profile.Location
 	functionTable map[string]*profile.Function
 	sampleTable   map[string]*profile.Sample
 }
 
-func newBuilder() *builder {
-	return &builder{
-		profile:       &profile.Profile{SampleType: []*profile.ValueType{{Type: "cpu", Unit: "samples"}}},
+func newBuilder(opts JfrToPprofOptions) *builder {
+	b := &builder{
+		profile:       &profile.Profile{},
+		valueIndex:    map[EventFamily]int{},
+		pid:           opts.PID,
+		symbolizer:    opts.Symbolizer,
 		locationTable: map[string]*profile.Location{},
 		functionTable: map[string]*profile.Function{},
 		sampleTable:   map[string]*profile.Sample{},
 	}
+
+	families := opts.EventFamilies
+	if families == nil {
+		families = DefaultJfrToPprofOptions().EventFamilies
+	}
+
+	for _, family := range families {
+		types, ok := sampleTypesByFamily[family]
+		if !ok {
+			continue
+		}
+		if _, ok := b.valueIndex[family]; ok {
+			continue
+		}
+		b.valueIndex[family] = len(b.profile.SampleType)
+		for _, st := range types {
+			b.profile.SampleType = append(b.profile.SampleType, st.valueType)
+		}
+	}
+
+	return b
 }
 
-func JfrToPprof(r io.Reader) (*profile.Profile, error) {
+func JfrToPprof(r io.Reader, opts JfrToPprofOptions) (*profile.Profile, error) {
 	chunks, err := parser.Parse(r)
 	if err != nil {
 		return nil, err
 	}
 
-	b := newBuilder()
+	b := newBuilder(opts)
 	for _, c := range chunks {
 		b.addJFRChunk(c)
 	}
@@ -53,32 +156,45 @@ func JfrToPprof(r io.Reader) (*profile.Profile, error) {
 }
 
 func (b *builder) addJFRChunk(c parser.Chunk) {
-	var event string
 	for _, e := range c.Events {
-		if as, ok := e.(*parser.ActiveSetting); ok {
-			// Extract the event name from the active setting.
-			if as.Name == "event" {
-				event = as.Value
+		switch ev := e.(type) {
+		case *parser.ExecutionSample:
+			if ev.State == nil || ev.State.Name != "STATE_RUNNABLE" {
+				continue
 			}
+			b.addSampleValue(EventFamilyCPU, 0, ev.StackTrace, 1)
+		case *parser.ThreadPark:
+			b.addSampleValue(EventFamilyOffCPU, 0, ev.StackTrace, ev.Duration)
+		case *parser.JavaMonitorWait:
+			b.addSampleValue(EventFamilyOffCPU, 0, ev.StackTrace, ev.Duration)
+		case *parser.ThreadSleep:
+			b.addSampleValue(EventFamilyOffCPU, 0, ev.StackTrace, ev.Duration)
+		case *parser.ObjectAllocationInNewTLAB:
+			b.addSampleValue(EventFamilyAllocation, 0, ev.StackTrace, ev.AllocationSize)
+			b.addSampleValue(EventFamilyAllocation, 1, ev.StackTrace, 1)
+		case *parser.ObjectAllocationOutsideTLAB:
+			b.addSampleValue(EventFamilyAllocation, 0, ev.StackTrace, ev.AllocationSize)
+			b.addSampleValue(EventFamilyAllocation, 1, ev.StackTrace, 1)
+		case *parser.NativeMethodSample:
+			b.addSampleValue(EventFamilyWall, 0, ev.StackTrace, 1)
 		}
 	}
-	if event != "cpu" {
-		return
-	}
+}
 
-	for _, event := range extractExecutionSampleEvents(c.Events) {
-		if event.State.Name == "STATE_RUNNABLE" {
-			increaseSample(b.getOrCreateSample(event.StackTrace))
-		}
+// addSampleValue adds value to the sample type at valueIndex[family]+offset,
+// aggregating by stack trace. It is a no-op if family wasn't requested
+// through JfrToPprofOptions.
+func (b *builder) addSampleValue(family EventFamily, offset int, st *parser.StackTrace, value int64) {
+	base, ok := b.valueIndex[family]
+	if !ok {
+		return
 	}
-}
 
-func increaseSample(s *profile.Sample) {
+	s := b.getOrCreateSample(st)
 	if s == nil {
 		return
 	}
-
-	s.Value[0]++
+	s.Value[base+offset] += value
 }
 
 func (b *builder) getOrCreateSample(st *parser.StackTrace) *profile.Sample {
@@ -89,13 +205,12 @@ func (b *builder) getOrCreateSample(st *parser.StackTrace) *profile.Sample {
 	locations := make([]*profile.Location, 0, len(st.Frames))
 	locationKeys := make([]string, 0, len(st.Frames))
 	for i := len(st.Frames) - 1; i >= 0; i-- {
-		f := st.Frames[i]
-		if f.Method != nil && f.Method.Type != nil && f.Method.Type.Name != nil && f.Method.Name != nil {
-			fun := b.getOrCreateFunction(f.Method.Type.Name.String + "." + f.Method.Name.String)
-			locKey, loc := b.getOrCreateLocation(fun, f.LineNumber)
-			locations = append(locations, loc)
-			locationKeys = append(locationKeys, locKey)
+		loc, locKey, ok := b.resolveFrame(st.Frames[i])
+		if !ok {
+			continue
 		}
+		locations = append(locations, loc)
+		locationKeys = append(locationKeys, locKey)
 	}
 
 	sampleKey := strings.Join(locationKeys, ";")
@@ -103,7 +218,7 @@ func (b *builder) getOrCreateSample(st *parser.StackTrace) *profile.Sample {
 	if !ok {
 		s = &profile.Sample{
 			Location: locations,
-			Value:    []int64{0},
+			Value:    make([]int64, len(b.profile.SampleType)),
 		}
 
 		b.sampleTable[sampleKey] = s
@@ -113,6 +228,67 @@ func (b *builder) getOrCreateSample(st *parser.StackTrace) *profile.Sample {
 	return s
 }
 
+// resolveFrame turns a single JFR stack frame into a pprof Location. It
+// handles three shapes:
+//
+//   - regular Java frames (Method, Method.Type and Method.Name all set):
+//     resolved to "<class>.<method>" as before.
+//   - native/JIT frames (Method.Type is nil because there's no Java class):
+//     named after the native symbol async-profiler already resolved, e.g.
+//     an AsyncGetCallTrace libc frame or a JVMTI CompiledMethodLoad stub.
+//   - native/JIT frames async-profiler couldn't resolve a symbol for,
+//     identified by a raw "0x..." address as their name: resolved via the
+//     injected Symbolizer against the recording's PID, so kernel/JIT/native
+//     stacks show up in the same flame graph as the Java frames above them.
+//
+// Frames that carry no usable information at all are skipped, matching the
+// previous behaviour of dropping frames with a nil Method/Type/Name.
+//
+// This deliberately doesn't branch on a frame "kind"/Type discriminator:
+// jfr-parser's StackFrame has no such field, just Method.Type being nil for
+// anything that isn't a Java method. So native vs. JIT vs. kernel is
+// inferred from the shape of the name async-profiler already gave the
+// frame (a resolved symbol, or a raw "0x..." address) rather than from a
+// constant-pool tag, which keeps this simple at the cost of not
+// distinguishing JIT-compiled frames from native ones by name alone.
+func (b *builder) resolveFrame(f *parser.StackFrame) (*profile.Location, string, bool) {
+	if f.Method != nil && f.Method.Type != nil && f.Method.Type.Name != nil && f.Method.Name != nil {
+		fun := b.getOrCreateFunction(f.Method.Type.Name.String + "." + f.Method.Name.String)
+		locKey, loc := b.getOrCreateLocation(fun, int64(f.LineNumber), uint64(f.LineNumber))
+		return loc, locKey, true
+	}
+
+	if f.Method == nil || f.Method.Name == nil {
+		return nil, "", false
+	}
+
+	name := f.Method.Name.String
+	if pc, ok := parseHexAddress(name); ok && b.symbolizer != nil {
+		if symName, line, ok := b.symbolizer.Symbolize(b.pid, pc); ok {
+			fun := b.getOrCreateFunction(symName)
+			locKey, loc := b.getOrCreateLocation(fun, line, pc)
+			return loc, locKey, true
+		}
+	}
+
+	fun := b.getOrCreateFunction(name)
+	locKey, loc := b.getOrCreateLocation(fun, 0, 0)
+	return loc, locKey, true
+}
+
+// parseHexAddress recognizes the "0x<hex>" names async-profiler gives
+// native frames it couldn't resolve a symbol for.
+func parseHexAddress(name string) (uint64, bool) {
+	if !strings.HasPrefix(name, "0x") {
+		return 0, false
+	}
+	addr, err := strconv.ParseUint(name[2:], 16, 64)
+	if err != nil {
+		return 0, false
+	}
+	return addr, true
+}
+
 func (b *builder) getOrCreateFunction(name string) *profile.Function {
 	if f, ok := b.functionTable[name]; ok {
 		return f
@@ -127,30 +303,18 @@ func (b *builder) getOrCreateFunction(name string) *profile.Function {
 	return f
 }
 
-func (b *builder) getOrCreateLocation(fun *profile.Function, line int32) (string, *profile.Location) {
-	line64 := int64(line)
-	key := fun.Name + ":" + strconv.FormatInt(line64, 10)
+func (b *builder) getOrCreateLocation(fun *profile.Function, line int64, address uint64) (string, *profile.Location) {
+	key := fun.Name + ":" + strconv.FormatInt(line, 10) + ":" + strconv.FormatUint(address, 16)
 	if l, ok := b.locationTable[key]; ok {
 		return key, l
 	}
 
 	l := &profile.Location{
 		ID:      uint64(len(b.locationTable) + 1),
-		Line:    []profile.Line{{Function: fun, Line: line64}},
-		Address: uint64(line),
+		Line:    []profile.Line{{Function: fun, Line: line}},
+		Address: address,
 	}
 	b.locationTable[key] = l
 	b.profile.Location = append(b.profile.Location, l)
 	return key, l
 }
-
-func extractExecutionSampleEvents(events []parser.Parseable) []*parser.ExecutionSample {
-	res := []*parser.ExecutionSample{}
-	for _, e := range events {
-		// There are a lot of events that we don't care about. We only care about on-CPU samples.
-		if es, ok := e.(*parser.ExecutionSample); ok {
-			res = append(res, es)
-		}
-	}
-	return res
-}
@@ -0,0 +1,218 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package convert
+
+import (
+	"testing"
+
+	"github.com/pyroscope-io/jfr-parser/parser"
+)
+
+// symbol and the frame helpers below build the small corner of parser's
+// constant-pool types that addJFRChunk reads (Method.Type.Name.String,
+// Method.Name.String, LineNumber). jfr-parser itself isn't vendored into
+// this tree, so these field names mirror the assumptions jfr.go already
+// makes about it rather than a verified upstream definition.
+func symbol(s string) *parser.Symbol {
+	return &parser.Symbol{String: s}
+}
+
+func javaFrame(class, method string, line int) *parser.StackFrame {
+	return &parser.StackFrame{
+		Method: &parser.Method{
+			Type: &parser.ClassRef{Name: symbol(class)},
+			Name: symbol(method),
+		},
+		LineNumber: int32(line),
+	}
+}
+
+func nativeFrame(name string) *parser.StackFrame {
+	return &parser.StackFrame{
+		Method: &parser.Method{Name: symbol(name)},
+	}
+}
+
+func stackTrace(frames ...*parser.StackFrame) *parser.StackTrace {
+	return &parser.StackTrace{Frames: frames}
+}
+
+func TestJfrToPprof_EventFamilies(t *testing.T) {
+	leaf := javaFrame("Worker", "run", 42)
+	root := javaFrame("Main", "main", 10)
+	st := stackTrace(root, leaf)
+
+	chunk := parser.Chunk{
+		Events: []parser.Event{
+			&parser.ExecutionSample{
+				State:      &parser.ThreadState{Name: "STATE_RUNNABLE"},
+				StackTrace: st,
+			},
+			&parser.ExecutionSample{
+				// Not runnable: historical behaviour drops these from the
+				// CPU profile.
+				State:      &parser.ThreadState{Name: "STATE_SLEEPING"},
+				StackTrace: st,
+			},
+			&parser.ThreadPark{Duration: 1000, StackTrace: st},
+			&parser.JavaMonitorWait{Duration: 2000, StackTrace: st},
+			&parser.ThreadSleep{Duration: 3000, StackTrace: st},
+			&parser.ObjectAllocationInNewTLAB{AllocationSize: 64, StackTrace: st},
+			&parser.ObjectAllocationOutsideTLAB{AllocationSize: 128, StackTrace: st},
+			&parser.NativeMethodSample{StackTrace: st},
+		},
+	}
+
+	b := newBuilder(JfrToPprofOptions{
+		EventFamilies: []EventFamily{
+			EventFamilyCPU, EventFamilyOffCPU, EventFamilyAllocation, EventFamilyWall,
+		},
+	})
+	b.addJFRChunk(chunk)
+
+	if len(b.profile.Sample) != 1 {
+		t.Fatalf("expected every event to aggregate into a single sample (same stack), got %d", len(b.profile.Sample))
+	}
+	s := b.profile.Sample[0]
+
+	wantByType := map[string]int64{
+		"cpu":           1,
+		"off_cpu":       1000 + 2000 + 3000,
+		"alloc_space":   64 + 128,
+		"alloc_objects": 2,
+		"wall":          1,
+	}
+	for i, st := range b.profile.SampleType {
+		want, ok := wantByType[st.Type]
+		if !ok {
+			t.Fatalf("unexpected sample type %q", st.Type)
+		}
+		if got := s.Value[i]; got != want {
+			t.Errorf("sample type %q = %d, want %d", st.Type, got, want)
+		}
+		delete(wantByType, st.Type)
+	}
+	if len(wantByType) != 0 {
+		t.Errorf("missing sample types: %v", wantByType)
+	}
+}
+
+func TestJfrToPprof_DefaultOptionsIsCPUOnly(t *testing.T) {
+	st := stackTrace(javaFrame("Main", "main", 1))
+	chunk := parser.Chunk{
+		Events: []parser.Event{
+			&parser.ExecutionSample{
+				State:      &parser.ThreadState{Name: "STATE_RUNNABLE"},
+				StackTrace: st,
+			},
+			&parser.NativeMethodSample{StackTrace: st},
+		},
+	}
+
+	b := newBuilder(JfrToPprofOptions{}) // zero value.
+	b.addJFRChunk(chunk)
+
+	if len(b.profile.SampleType) != 1 || b.profile.SampleType[0].Type != "cpu" {
+		t.Fatalf("zero-value JfrToPprofOptions should behave like DefaultJfrToPprofOptions (cpu-only), got sample types %+v", b.profile.SampleType)
+	}
+	if len(b.profile.Sample) != 1 || b.profile.Sample[0].Value[0] != 1 {
+		t.Fatalf("expected one cpu sample of value 1, got %+v", b.profile.Sample)
+	}
+}
+
+func TestJfrToPprof_SeparateStacksDoNotAggregate(t *testing.T) {
+	stA := stackTrace(javaFrame("A", "a", 1))
+	stB := stackTrace(javaFrame("B", "b", 1))
+
+	chunk := parser.Chunk{
+		Events: []parser.Event{
+			&parser.ExecutionSample{State: &parser.ThreadState{Name: "STATE_RUNNABLE"}, StackTrace: stA},
+			&parser.ExecutionSample{State: &parser.ThreadState{Name: "STATE_RUNNABLE"}, StackTrace: stB},
+		},
+	}
+
+	b := newBuilder(DefaultJfrToPprofOptions())
+	b.addJFRChunk(chunk)
+
+	if len(b.profile.Sample) != 2 {
+		t.Fatalf("expected 2 distinct samples for 2 distinct stacks, got %d", len(b.profile.Sample))
+	}
+}
+
+func TestResolveFrame_SymbolizesUnresolvedNativeAddress(t *testing.T) {
+	const pid = 1234
+	sym := &stubSymbolizer{
+		results: map[uint64]string{0xdeadbeef: "libc.so.6`malloc"},
+	}
+
+	b := newBuilder(JfrToPprofOptions{PID: pid, Symbolizer: sym})
+	loc, _, ok := b.resolveFrame(nativeFrame("0xdeadbeef"))
+	if !ok {
+		t.Fatalf("expected frame to resolve")
+	}
+	if got := loc.Line[0].Function.Name; got != "libc.so.6`malloc" {
+		t.Errorf("function name = %q, want symbolized name", got)
+	}
+	if sym.gotPID != pid {
+		t.Errorf("Symbolize called with pid %d, want %d", sym.gotPID, pid)
+	}
+}
+
+func TestResolveFrame_FallsBackWithoutSymbolizer(t *testing.T) {
+	b := newBuilder(JfrToPprofOptions{}) // no Symbolizer.
+	loc, _, ok := b.resolveFrame(nativeFrame("0xdeadbeef"))
+	if !ok {
+		t.Fatalf("expected frame to resolve")
+	}
+	if got := loc.Line[0].Function.Name; got != "0xdeadbeef" {
+		t.Errorf("function name = %q, want raw frame name", got)
+	}
+}
+
+type stubSymbolizer struct {
+	results map[uint64]string
+	gotPID  int
+}
+
+func (s *stubSymbolizer) Symbolize(pid int, pc uint64) (string, int64, bool) {
+	s.gotPID = pid
+	name, ok := s.results[pc]
+	return name, 0, ok
+}
+
+func TestParseHexAddress(t *testing.T) {
+	tests := []struct {
+		name   string
+		wantPC uint64
+		wantOK bool
+	}{
+		{name: "0x7f1234567890", wantPC: 0x7f1234567890, wantOK: true},
+		{name: "0x0", wantPC: 0, wantOK: true},
+		{name: "java.lang.Object.wait", wantOK: false},
+		{name: "", wantOK: false},
+		{name: "0xzzzz", wantOK: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pc, ok := parseHexAddress(tt.name)
+			if ok != tt.wantOK {
+				t.Fatalf("parseHexAddress(%q) ok = %v, want %v", tt.name, ok, tt.wantOK)
+			}
+			if ok && pc != tt.wantPC {
+				t.Fatalf("parseHexAddress(%q) = %#x, want %#x", tt.name, pc, tt.wantPC)
+			}
+		})
+	}
+}
@@ -0,0 +1,24 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !libbpfgo
+
+package cpu
+
+// unwind_bpfel.o and unwind_bpfeb.o are not checked into version control
+// (see .gitignore) and must be generated locally with `go generate` before
+// this package will build: unwind_bpfel.go and unwind_bpfeb.go embed them
+// via go:embed, and the embed fails at compile time if they're missing.
+// This is deliberate — don't commit placeholder/stub .o files here.
+//
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -target bpfel,bpfeb -cc clang -cflags "-O2 -g -Wall -Werror" unwind ./bpf/unwind.bpf.c -- -I./bpf
@@ -1,4 +1,4 @@
-// Copyright 2022 The Parca Authors
+// Copyright 2023 The Parca Authors
 // Licensed under the Apache License, Version 2.0 (the "License");
 // you may not use this file except in compliance with the License.
 // You may obtain a copy of the License at
@@ -10,30 +10,35 @@
 // WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 // See the License for the specific language governing permissions and
 // limitations under the License.
-//
 
-package cpu
+//go:build !libbpfgo
 
-import "C"
+package cpu
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"unsafe"
+
+	"github.com/cilium/ebpf"
 
 	"github.com/parca-dev/parca-agent/internal/dwarf/frame"
+	"github.com/parca-dev/parca-agent/pkg/runtime/cgroups"
 	"github.com/parca-dev/parca-agent/pkg/stack/unwind"
-
-	bpf "github.com/aquasecurity/libbpfgo"
 )
 
 const (
-	stackCountsMapName = "stack_counts"
-	stackTracesMapName = "stack_traces"
-	unwindTableMapName = "unwind_tables"
-	maxUnwindTableSize = 130 * 1000 // Always needs to be sync with MAX_UNWIND_TABLE_SIZE in BPF program.
+	maxUnwindTableSize = 130 * 1000 // Always needs to be in sync with MAX_UNWIND_TABLE_SIZE in bpf/unwind.bpf.c.
+
+	// cleanBatchSize is how many keys we ask the kernel for in a single
+	// BatchLookupAndDelete call. It trades off syscall count against the
+	// size of the buffers we have to allocate up front.
+	cleanBatchSize = 4096
+
+	// cfaRegExpression is the reserved cfa_reg value (CFA_REG_EXPRESSION in
+	// bpf/unwind.bpf.c) meaning "cfa_offset is an id into unwind_expressions,
+	// not a DWARF register number".
+	cfaRegExpression = 0xFFFFFFFF
 )
 
 var (
@@ -42,12 +47,59 @@ var (
 	errUnrecoverable = errors.New("unrecoverable error")
 )
 
+// bpfMaps wraps the cilium/ebpf handles for the maps generated from
+// bpf/unwind.bpf.c by bpf2go (see gen.go and unwind_bpf{el,eb}.go). It is a
+// drop-in replacement for the libbpfgo-backed implementation in
+// maps_libbpfgo.go, kept alongside it behind the libbpfgo build tag while
+// the migration is rolled out.
 type bpfMaps struct {
 	byteOrder binary.ByteOrder
 
-	stackCounts  *bpf.BPFMap
-	stackTraces  *bpf.BPFMap
-	unwindTables *bpf.BPFMap
+	objs unwindObjects
+
+	// expressions holds the CFA DWARF expressions compiled so far, keyed
+	// by the id written into unwind_row.cfa_offset. Expressions are
+	// deduplicated across every PID's unwind table, since the same
+	// prologue/epilogue shape is shared by many functions.
+	expressions *unwind.ExpressionTable
+
+	// budget caps the total number of unwind table rows kept across every
+	// tracked PID, derived from the container's memory limit. It is nil
+	// when no limit could be determined, in which case no eviction happens
+	// beyond the existing per-PID maxUnwindTableSize check.
+	budget *cgroups.Budget
+
+	// rowsByPID and lastUsedByPID track enough state to evict the
+	// least-recently-sampled PID when budget.MaxUnwindTableRows() would
+	// otherwise be exceeded.
+	rowsByPID     map[uint32]int
+	lastUsedByPID map[uint32]uint64
+	totalRows     int
+	clock         uint64
+}
+
+// newBPFMaps loads the unwind BPF objects and wraps their maps. budget may
+// be nil, in which case unwind tables are never evicted for memory
+// pressure.
+func newBPFMaps(budget *cgroups.Budget) (*bpfMaps, error) {
+	var objs unwindObjects
+	if err := loadUnwindObjects(&objs, nil); err != nil {
+		return nil, fmt.Errorf("load unwind bpf objects: %w", err)
+	}
+
+	return &bpfMaps{
+		byteOrder:     binary.LittleEndian,
+		objs:          objs,
+		expressions:   unwind.NewExpressionTable(),
+		budget:        budget,
+		rowsByPID:     map[uint32]int{},
+		lastUsedByPID: map[uint32]uint64{},
+	}, nil
+}
+
+// Close releases the underlying map file descriptors.
+func (m *bpfMaps) Close() error {
+	return m.objs.Close()
 }
 
 // readUserStack reads the user stack trace from the stacktraces ebpf map into the given buffer.
@@ -56,14 +108,11 @@ func (m *bpfMaps) readUserStack(userStackID int32, stack *combinedStack) error {
 		return errUnwindFailed
 	}
 
-	stackBytes, err := m.stackTraces.GetValue(unsafe.Pointer(&userStackID))
-	if err != nil {
+	var raw [stackDepth]uint64
+	if err := m.objs.StackTraces.Lookup(&userStackID, &raw); err != nil {
 		return fmt.Errorf("read user stack trace, %v: %w", err, errMissing)
 	}
-
-	if err := binary.Read(bytes.NewBuffer(stackBytes), m.byteOrder, stack[:stackDepth]); err != nil {
-		return fmt.Errorf("read user stack bytes, %s: %w", err, errUnrecoverable)
-	}
+	copy(stack[:stackDepth], raw[:])
 
 	return nil
 }
@@ -74,162 +123,248 @@ func (m *bpfMaps) readKernelStack(kernelStackID int32, stack *combinedStack) err
 		return errUnwindFailed
 	}
 
-	stackBytes, err := m.stackTraces.GetValue(unsafe.Pointer(&kernelStackID))
-	if err != nil {
+	var raw [stackDepth]uint64
+	if err := m.objs.StackTraces.Lookup(&kernelStackID, &raw); err != nil {
 		return fmt.Errorf("read kernel stack trace, %v: %w", err, errMissing)
 	}
-
-	if err := binary.Read(bytes.NewBuffer(stackBytes), m.byteOrder, stack[stackDepth:]); err != nil {
-		return fmt.Errorf("read kernel stack bytes, %s: %w", err, errUnrecoverable)
-	}
+	copy(stack[stackDepth:], raw[:])
 
 	return nil
 }
 
 // readStackCount reads the value of the given key from the counts ebpf map.
 func (m *bpfMaps) readStackCount(keyBytes []byte) (uint64, error) {
-	valueBytes, err := m.stackCounts.GetValue(unsafe.Pointer(&keyBytes[0]))
-	if err != nil {
+	key := m.byteOrder.Uint32(keyBytes)
+
+	var value uint64
+	if err := m.objs.StackCounts.Lookup(&key, &value); err != nil {
 		return 0, fmt.Errorf("get count value: %w", err)
 	}
-	return m.byteOrder.Uint64(valueBytes), nil
+	return value, nil
 }
 
+// clean drains the stack_traces and stack_counts maps using
+// BatchLookupAndDelete, which needs a handful of syscalls regardless of how
+// many stack traces accumulated since the last clean, instead of one
+// iterator step and one delete per key.
 func (m *bpfMaps) clean() error {
-	// BPF iterators need the previous value to iterate to the next, so we
-	// can only delete the "previous" item once we've already iterated to
-	// the next.
-
-	it := m.stackTraces.Iterator()
-	var prev []byte = nil
-	for it.Next() {
-		if prev != nil {
-			err := m.stackTraces.DeleteKey(unsafe.Pointer(&prev[0]))
-			if err != nil {
-				return fmt.Errorf("failed to delete stack trace: %w", err)
-			}
-		}
+	if err := batchDeleteAll[uint32, [stackDepth]uint64](m.objs.StackTraces); err != nil {
+		return fmt.Errorf("failed to delete stack traces: %w", err)
+	}
 
-		key := it.Key()
-		prev = make([]byte, len(key))
-		copy(prev, key)
+	if err := batchDeleteAll[uint32, uint64](m.objs.StackCounts); err != nil {
+		return fmt.Errorf("failed to delete counts: %w", err)
 	}
-	if prev != nil {
-		err := m.stackTraces.DeleteKey(unsafe.Pointer(&prev[0]))
-		if err != nil {
-			return fmt.Errorf("failed to delete stack trace: %w", err)
+
+	return nil
+}
+
+// batchDeleteAll drains every entry of m in batches of cleanBatchSize.
+func batchDeleteAll[K, V any](m *ebpf.Map) error {
+	keys := make([]K, cleanBatchSize)
+	values := make([]V, cleanBatchSize)
+
+	var cursor ebpf.MapBatchCursor
+	for {
+		count, err := m.BatchLookupAndDelete(&cursor, keys, values, nil)
+		done := errors.Is(err, ebpf.ErrKeyNotExist)
+		if err != nil && !done {
+			return fmt.Errorf("batch lookup and delete (read %d entries): %w", count, err)
+		}
+		if done {
+			return nil
 		}
 	}
+}
 
-	it = m.stackCounts.Iterator()
-	prev = nil
-	for it.Next() {
-		if prev != nil {
-			err := m.stackCounts.DeleteKey(unsafe.Pointer(&prev[0]))
-			if err != nil {
-				return fmt.Errorf("failed to delete count: %w", err)
-			}
+// writeRow translates a single unwind.Row into its BPF representation,
+// resolving DWARF CFA expressions (frame.RuleExpression) into an id in
+// m.expressions instead of the historical 0xBEEF/0xBADFAD sentinel.
+func (m *bpfMaps) writeRow(dst *unwindUnwindRow, row unwind.Row) error {
+	// Right now we only support x86_64, where the return address position
+	// is specified in the ABI, so we don't write it.
+	dst.Pc = row.Loc
+
+	switch row.CFA.Rule {
+	case frame.RuleCFA:
+		dst.CfaReg = row.CFA.Reg
+		dst.CfaOffset = uint64(row.CFA.Offset)
+	case frame.RuleExpression:
+		compiled, ok := unwind.CompileExpression(row.CFA.Expression)
+		if !ok {
+			// The expression uses an opcode our tiny BPF stack machine
+			// doesn't support (e.g. DW_OP_addr). We have no safe CFA to
+			// fall back to, so mark the row as un-unwindable rather than
+			// silently producing a wrong answer.
+			dst.CfaReg = cfaRegExpression
+			dst.CfaOffset = ^uint64(0)
+			break
 		}
+		dst.CfaReg = cfaRegExpression
+		dst.CfaOffset = m.expressions.Add(compiled)
+	default:
+		return fmt.Errorf("CFA rule is not valid. This should never happen")
+	}
 
-		key := it.Key()
-		prev = make([]byte, len(key))
-		copy(prev, key)
+	dst.RbpOffset = uint64(row.RBP.Offset)
+	return nil
+}
+
+// trackPID records that pid now holds rows rows in unwind_tables and was
+// just (re)populated, then evicts the least-recently-sampled PIDs until the
+// total stays within m.budget.MaxUnwindTableRows(). It is a no-op when
+// m.budget is nil, i.e. no cgroup memory limit could be determined.
+func (m *bpfMaps) trackPID(pid uint32, rows int) error {
+	m.clock++
+	m.totalRows += rows - m.rowsByPID[pid]
+	m.rowsByPID[pid] = rows
+	m.lastUsedByPID[pid] = m.clock
+
+	m.budget.SetUnwindTableRowsInUse(m.totalRows)
+
+	maxRows := m.budget.MaxUnwindTableRows()
+	if maxRows == 0 {
+		return nil
 	}
-	if prev != nil {
-		err := m.stackCounts.DeleteKey(unsafe.Pointer(&prev[0]))
-		if err != nil {
-			return fmt.Errorf("failed to delete count: %w", err)
+
+	for m.totalRows > maxRows {
+		evict, ok := m.leastRecentlyUsedPID(pid)
+		if !ok {
+			break
 		}
+
+		key := evict
+		if err := m.objs.UnwindTables.Delete(&key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("evict unwind table for pid %d: %w", evict, err)
+		}
+
+		m.totalRows -= m.rowsByPID[evict]
+		delete(m.rowsByPID, evict)
+		delete(m.lastUsedByPID, evict)
+		m.budget.IncUnwindTableEviction()
 	}
+	m.budget.SetUnwindTableRowsInUse(m.totalRows)
 
 	return nil
 }
 
-// setUnwindTable updates the unwind tables with the given unwind table.
-func (m *bpfMaps) setUnwindTable(pid int, ut unwind.UnwindTable) error {
-	buf := new(bytes.Buffer)
-
-	// Write number of rows `.table_len``.
-	if err := binary.Write(buf, m.byteOrder, uint64(len(ut))); err != nil {
-		return fmt.Errorf("write the number of rows: %w", err)
+// leastRecentlyUsedPID returns the tracked PID with the oldest
+// lastUsedByPID entry, excluding keep (the PID we just populated, which
+// should never be evicted to make room for itself).
+func (m *bpfMaps) leastRecentlyUsedPID(keep uint32) (uint32, bool) {
+	var (
+		oldestPID   uint32
+		oldestClock uint64
+		found       bool
+	)
+
+	for pid, clock := range m.lastUsedByPID {
+		if pid == keep {
+			continue
+		}
+		if !found || clock < oldestClock {
+			oldestPID, oldestClock, found = pid, clock, true
+		}
 	}
 
+	return oldestPID, found
+}
+
+// setUnwindTable updates the unwind tables with the given unwind table.
+func (m *bpfMaps) setUnwindTable(pid int, ut unwind.UnwindTable) error {
 	if len(ut) >= maxUnwindTableSize {
-		fmt.Errorf("Maximum unwind table size reached. Table size %d, but max size is %d", len(ut), maxUnwindTableSize)
+		return fmt.Errorf("maximum unwind table size reached, table size %d but max size is %d", len(ut), maxUnwindTableSize)
 	}
 
-	for _, row := range ut {
-		// Right now we only support x86_64, where the return address position
-		// is specified in the ABI, so we don't write it.
+	var table unwindUnwindTable
+	table.TableLen = uint64(len(ut))
 
-		// Write Program Counter (PC).
-		if err := binary.Write(buf, m.byteOrder, row.Loc); err != nil {
-			return fmt.Errorf("write the program counter: %w", err)
+	for i, row := range ut {
+		if err := m.writeRow(&table.Rows[i], row); err != nil {
+			return err
 		}
+	}
 
-		// Write CFA.
-		switch row.CFA.Rule {
-		case frame.RuleCFA:
-			// Write CFA register.
-			if err := binary.Write(buf, m.byteOrder, row.CFA.Reg); err != nil {
-				return fmt.Errorf("write CFA register bytes: %w", err)
-			}
+	key := uint32(pid)
+	if err := m.objs.UnwindTables.Update(&key, &table, ebpf.UpdateAny); err != nil {
+		return fmt.Errorf("update unwind tables: %w", err)
+	}
 
-			// Write CFA offset.
-			if err := binary.Write(buf, m.byteOrder, row.CFA.Offset); err != nil {
-				return fmt.Errorf("write CFA offset bytes: %w", err)
-			}
-		case frame.RuleExpression:
-			// Hack(javierhonduco). Expressions aren't really implemented yet, so let's set some sentinel
-			// values that we can use in the unwinder to detect when we should be using an expression.
+	if err := m.trackPID(key, len(ut)); err != nil {
+		return err
+	}
 
-			// Write "fake" register.
-			if err := binary.Write(buf, m.byteOrder, uint64(0xBEEF)); err != nil {
-				return fmt.Errorf("write CFA Reg bytes: %w", err)
-			}
+	return m.flushExpressions()
+}
+
+// setUnwindTables updates the unwind tables for several PIDs in a single
+// syscall via BatchUpdate, which is considerably cheaper than issuing one
+// Update per PID when (re)populating the map for many processes at once,
+// e.g. right after attaching to a busy container.
+func (m *bpfMaps) setUnwindTables(tables map[int]unwind.UnwindTable) error {
+	keys := make([]uint32, 0, len(tables))
+	values := make([]unwindUnwindTable, 0, len(tables))
+
+	for pid, ut := range tables {
+		if len(ut) >= maxUnwindTableSize {
+			return fmt.Errorf("maximum unwind table size reached, table size %d but max size is %d", len(ut), maxUnwindTableSize)
+		}
 
-			// Write "fake" offset.
-			if err := binary.Write(buf, m.byteOrder, uint64(0xBADFAD)); err != nil {
-				return fmt.Errorf("write CFA offset bytes: %w", err)
+		var table unwindUnwindTable
+		table.TableLen = uint64(len(ut))
+		for i, row := range ut {
+			if err := m.writeRow(&table.Rows[i], row); err != nil {
+				return err
 			}
-		default:
-			return fmt.Errorf("CFA rule is not valid. This should never happen")
 		}
 
-		// Write $rbp offset.
-		if err := binary.Write(buf, m.byteOrder, row.RBP.Offset); err != nil {
-			return fmt.Errorf("write RBP offset bytes: %w", err)
+		keys = append(keys, uint32(pid))
+		values = append(values, table)
+	}
+
+	if _, err := m.objs.UnwindTables.BatchUpdate(keys, values, nil); err != nil {
+		return fmt.Errorf("batch update unwind tables: %w", err)
+	}
+
+	for pid, ut := range tables {
+		if err := m.trackPID(uint32(pid), len(ut)); err != nil {
+			return err
 		}
 	}
 
-	// Set PID -> unwind table.
-	if err := m.unwindTables.Update(unsafe.Pointer(&pid), unsafe.Pointer(&buf.Bytes()[0])); err != nil {
-		return fmt.Errorf("update unwind tables: %w", err)
+	return m.flushExpressions()
+}
+
+// flushExpressions writes the CFA expressions compiled since the last call
+// to flushExpressions into unwind_expressions, keyed by the id handed out
+// by m.expressions.Add. It only uploads the new entries: re-uploading
+// m.expressions' full history on every setUnwindTable/setUnwindTables call
+// would make each of those calls cost O(total expressions ever compiled)
+// instead of O(expressions compiled for this call), defeating the point of
+// using BatchUpdate in the first place.
+func (m *bpfMaps) flushExpressions() error {
+	firstID, exprs := m.expressions.NewSince()
+	if len(exprs) == 0 {
+		return nil
 	}
 
-	// HACK(javierhonduco): remove this.
-	// Debug stuff to compare this with the BPF program's view of the world.
-	/*
-		printRow := func(w io.Writer, pt unwind.UnwindTable, index int) {
-			cfaInfo := ""
-			switch ut[index].CFA.Rule {
-			case frame.RuleCFA:
-				cfaInfo = fmt.Sprintf("CFA Reg: %d Offset:%d", ut[index].CFA.Reg, ut[index].CFA.Offset)
-			case frame.RuleExpression:
-				cfaInfo = "CFA exp"
-			default:
-				panic("CFA rule is not valid. This should never happen.")
-			}
+	keys := make([]uint64, len(exprs))
+	values := make([]unwindExpressionProgram, len(exprs))
+	for i, expr := range exprs {
+		keys[i] = firstID + uint64(i)
 
-			fmt.Fprintf(w, "\trow[%d]. Loc: %x, %s, $rbp: %d\n", index, pt[index].Loc, cfaInfo, pt[index].RBP.Offset)
+		var prog unwindExpressionProgram
+		prog.Len = uint32(len(expr.Steps))
+		for j, step := range expr.Steps {
+			prog.Steps[j].Op = uint8(step.Op)
+			prog.Steps[j].Operand = step.Operand
 		}
+		values[i] = prog
+	}
+
+	if _, err := m.objs.UnwindExpressions.BatchUpdate(keys, values, nil); err != nil {
+		return fmt.Errorf("batch update unwind expressions: %w", err)
+	}
 
-		fmt.Fprintf(os.Stdout, "\t- Total entries %d\n\n", len(ut))
-		printRow(os.Stdout, ut, 0)
-		printRow(os.Stdout, ut, 1)
-		printRow(os.Stdout, ut, 2)
-		printRow(os.Stdout, ut, 6)
-		printRow(os.Stdout, ut, len(ut)-1)
-	*/
 	return nil
 }
@@ -0,0 +1,91 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !libbpfgo
+
+package cpu
+
+import (
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/rlimit"
+)
+
+// benchStackCountsMap creates a throwaway map with the same layout as
+// stack_counts and seeds it with n entries.
+func benchStackCountsMap(tb testing.TB, n int) *ebpf.Map {
+	tb.Helper()
+
+	if err := rlimit.RemoveMemlock(); err != nil {
+		tb.Skipf("removing memlock rlimit: %s", err)
+	}
+
+	m, err := ebpf.NewMap(&ebpf.MapSpec{
+		Type:       ebpf.Hash,
+		KeySize:    4,
+		ValueSize:  8,
+		MaxEntries: uint32(n),
+	})
+	if err != nil {
+		tb.Skipf("creating bpf map (likely missing privileges): %s", err)
+	}
+	tb.Cleanup(func() { m.Close() })
+
+	for i := 0; i < n; i++ {
+		key, value := uint32(i), uint64(i)
+		if err := m.Put(&key, &value); err != nil {
+			tb.Fatalf("seeding map: %s", err)
+		}
+	}
+
+	return m
+}
+
+// BenchmarkMapCleanupIterate mirrors the old clean() behaviour: one
+// iterator step and one delete syscall per key.
+func BenchmarkMapCleanupIterate(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		m := benchStackCountsMap(b, 5000)
+		b.StartTimer()
+
+		it := m.Iterate()
+		var key uint32
+		var value uint64
+		var pending []uint32
+		for it.Next(&key, &value) {
+			pending = append(pending, key)
+		}
+		for _, k := range pending {
+			k := k
+			if err := m.Delete(&k); err != nil {
+				b.Fatalf("delete: %s", err)
+			}
+		}
+	}
+}
+
+// BenchmarkMapCleanupBatch exercises the BatchLookupAndDelete-based clean(),
+// which drains the same map in a handful of syscalls instead of one per key.
+func BenchmarkMapCleanupBatch(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		m := benchStackCountsMap(b, 5000)
+		b.StartTimer()
+
+		if err := batchDeleteAll[uint32, uint64](m); err != nil {
+			b.Fatalf("batch delete all: %s", err)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroups
+
+const (
+	// unwindTableRowSize is the serialized size in bytes of a single
+	// in-kernel unwind table row (see struct unwind_row in
+	// pkg/profiler/cpu/bpf/unwind.bpf.c: pc, cfa_reg, cfa_offset,
+	// rbp_offset, each a u64).
+	unwindTableRowSize = 4 * 8
+
+	// unwindTableBudgetFraction is the share of the container memory limit
+	// the in-kernel unwind tables, summed across every tracked PID, are
+	// allowed to occupy.
+	unwindTableBudgetFraction = 0.20
+)
+
+// Budget exposes resource budgets derived from the cgroup limits Tune
+// applied, for callers that need to size in-kernel data structures relative
+// to the same limits the Go runtime was tuned against.
+type Budget struct {
+	memoryLimit int64
+}
+
+// MemoryLimit is the memory limit the budget was derived from (memory.high,
+// falling back to memory.max). Zero means no limit could be determined.
+func (b *Budget) MemoryLimit() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.memoryLimit
+}
+
+// MaxUnwindTableRows returns how many unwind table rows, summed across
+// every tracked PID, the in-kernel unwind_tables map may hold before the
+// least-recently-sampled PID should be evicted. It returns 0 if no memory
+// limit could be determined, in which case the caller should fall back to
+// its own static default instead of evicting.
+//
+// Only the cilium/ebpf backend (pkg/profiler/cpu/maps.go) consults this:
+// the legacy libbpfgo backend (pkg/profiler/cpu/maps_libbpfgo.go) has no
+// eviction loop and isn't getting one, since it's frozen pending removal.
+func (b *Budget) MaxUnwindTableRows() int {
+	if b == nil || b.memoryLimit <= 0 {
+		return 0
+	}
+
+	budgetBytes := float64(b.memoryLimit) * unwindTableBudgetFraction
+	return int(budgetBytes / unwindTableRowSize)
+}
+
+// SetUnwindTableRowsInUse reports how many unwind table rows are currently
+// populated, across every tracked PID, for the parca_agent_unwind_table_rows_in_use
+// metric. It is a no-op on a nil Budget.
+func (b *Budget) SetUnwindTableRowsInUse(n int) {
+	if b == nil {
+		return
+	}
+	unwindTableRowsInUse.Set(float64(n))
+}
+
+// IncUnwindTableEviction reports that a PID was evicted from the unwind
+// tables to stay within budget. It is a no-op on a nil Budget.
+func (b *Budget) IncUnwindTableEviction() {
+	if b == nil {
+		return
+	}
+	unwindTableEvictions.Inc()
+}
@@ -0,0 +1,176 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cgroups reads the CPU and memory limits of the cgroup the current
+// process belongs to, so the agent can size itself to the resources
+// Kubernetes actually granted it rather than to the host's.
+package cgroups
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Version identifies which cgroup hierarchy is mounted on the host.
+type Version int
+
+const (
+	VersionUnknown Version = iota
+	VersionV1
+	VersionV2
+)
+
+// Limits holds the resource limits read from the current process' cgroup.
+type Limits struct {
+	// CPUQuota is the number of CPU cores the cgroup is allowed to use,
+	// e.g. 2.5 for a 250000/100000 us quota/period pair. Zero means no
+	// quota is set.
+	CPUQuota float64
+	// MemoryMax is the hard memory limit in bytes (memory.max on v2,
+	// memory.limit_in_bytes on v1). Zero means no limit is set.
+	MemoryMax int64
+	// MemoryHigh is the soft memory limit in bytes (memory.high, v2 only).
+	// Zero means no limit is set.
+	MemoryHigh int64
+}
+
+const (
+	cgroupV2MountPoint = "/sys/fs/cgroup"
+	cgroupV1CPUPath    = "/sys/fs/cgroup/cpu"
+	cgroupV1MemoryPath = "/sys/fs/cgroup/memory"
+
+	// v1MemoryUnlimited is the sentinel cgroup v1 reports in
+	// memory.limit_in_bytes when no limit is set, instead of omitting the
+	// file. It's page-aligned math.MaxInt64 on every kernel we've seen.
+	v1MemoryUnlimited = 1 << 62
+)
+
+// DetectVersion figures out whether the host uses the unified cgroup v2
+// hierarchy or the legacy v1 controllers.
+func DetectVersion() Version {
+	if _, err := os.Stat(filepath.Join(cgroupV2MountPoint, "cgroup.controllers")); err == nil {
+		return VersionV2
+	}
+	if _, err := os.Stat(cgroupV1CPUPath); err == nil {
+		return VersionV1
+	}
+	return VersionUnknown
+}
+
+// ReadLimits reads the CPU and memory limits of the cgroup the current
+// process belongs to. It returns the zero Limits, without error, when no
+// cgroup filesystem is mounted (e.g. running outside of a container).
+func ReadLimits() (Limits, error) {
+	switch DetectVersion() {
+	case VersionV2:
+		return readLimitsV2(cgroupV2MountPoint)
+	case VersionV1:
+		return readLimitsV1(cgroupV1CPUPath, cgroupV1MemoryPath)
+	default:
+		return Limits{}, nil
+	}
+}
+
+func readLimitsV2(mountPoint string) (Limits, error) {
+	var l Limits
+
+	quota, period, err := readCPUMaxV2(filepath.Join(mountPoint, "cpu.max"))
+	if err != nil {
+		return Limits{}, fmt.Errorf("read cpu.max: %w", err)
+	}
+	if quota > 0 && period > 0 {
+		l.CPUQuota = float64(quota) / float64(period)
+	}
+
+	if max, err := readInt64File(filepath.Join(mountPoint, "memory.max")); err == nil {
+		l.MemoryMax = max
+	}
+	if high, err := readInt64File(filepath.Join(mountPoint, "memory.high")); err == nil {
+		l.MemoryHigh = high
+	}
+
+	return l, nil
+}
+
+func readCPUMaxV2(path string) (quota, period int64, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	fields := strings.Fields(strings.TrimSpace(string(data)))
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("unexpected cpu.max format: %q", string(data))
+	}
+	if fields[0] == "max" {
+		return 0, 0, nil
+	}
+
+	quota, err = strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("parse cpu quota: %w", err)
+	}
+	period, err = strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("parse cpu period: %w", err)
+	}
+	return quota, period, nil
+}
+
+func readLimitsV1(cpuPath, memoryPath string) (Limits, error) {
+	var l Limits
+
+	quotaUs, err := readInt64File(filepath.Join(cpuPath, "cpu.cfs_quota_us"))
+	if err != nil {
+		return Limits{}, fmt.Errorf("read cpu.cfs_quota_us: %w", err)
+	}
+	periodUs, err := readInt64File(filepath.Join(cpuPath, "cpu.cfs_period_us"))
+	if err != nil {
+		return Limits{}, fmt.Errorf("read cpu.cfs_period_us: %w", err)
+	}
+	// cgroup v1 represents "no quota" as -1 rather than omitting the file.
+	if quotaUs > 0 && periodUs > 0 {
+		l.CPUQuota = float64(quotaUs) / float64(periodUs)
+	}
+
+	max, err := readInt64File(filepath.Join(memoryPath, "memory.limit_in_bytes"))
+	if err != nil {
+		return Limits{}, fmt.Errorf("read memory.limit_in_bytes: %w", err)
+	}
+	if max < v1MemoryUnlimited {
+		l.MemoryMax = max
+	}
+
+	return l, nil
+}
+
+func readInt64File(path string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	s := strings.TrimSpace(string(data))
+	if s == "max" {
+		return 0, nil
+	}
+
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return v, nil
+}
@@ -0,0 +1,126 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroups
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFile(t *testing.T, dir, name, contents string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0o644); err != nil {
+		t.Fatalf("writing %s: %s", name, err)
+	}
+}
+
+func TestReadLimitsV2(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "cpu.max", "250000 100000\n")
+	writeFile(t, dir, "memory.max", "1073741824\n")
+	writeFile(t, dir, "memory.high", "805306368\n")
+
+	limits, err := readLimitsV2(dir)
+	if err != nil {
+		t.Fatalf("readLimitsV2: %s", err)
+	}
+
+	if limits.CPUQuota != 2.5 {
+		t.Errorf("CPUQuota = %v, want 2.5", limits.CPUQuota)
+	}
+	if limits.MemoryMax != 1073741824 {
+		t.Errorf("MemoryMax = %v, want 1073741824", limits.MemoryMax)
+	}
+	if limits.MemoryHigh != 805306368 {
+		t.Errorf("MemoryHigh = %v, want 805306368", limits.MemoryHigh)
+	}
+}
+
+func TestReadLimitsV2Unlimited(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "cpu.max", "max 100000\n")
+	writeFile(t, dir, "memory.max", "max\n")
+	writeFile(t, dir, "memory.high", "max\n")
+
+	limits, err := readLimitsV2(dir)
+	if err != nil {
+		t.Fatalf("readLimitsV2: %s", err)
+	}
+
+	if limits.CPUQuota != 0 {
+		t.Errorf("CPUQuota = %v, want 0", limits.CPUQuota)
+	}
+	if limits.MemoryMax != 0 {
+		t.Errorf("MemoryMax = %v, want 0", limits.MemoryMax)
+	}
+	if limits.MemoryHigh != 0 {
+		t.Errorf("MemoryHigh = %v, want 0", limits.MemoryHigh)
+	}
+}
+
+func TestReadLimitsV1(t *testing.T) {
+	cpuDir := t.TempDir()
+	memDir := t.TempDir()
+
+	writeFile(t, cpuDir, "cpu.cfs_quota_us", "150000\n")
+	writeFile(t, cpuDir, "cpu.cfs_period_us", "100000\n")
+	writeFile(t, memDir, "memory.limit_in_bytes", "536870912\n")
+
+	limits, err := readLimitsV1(cpuDir, memDir)
+	if err != nil {
+		t.Fatalf("readLimitsV1: %s", err)
+	}
+
+	if limits.CPUQuota != 1.5 {
+		t.Errorf("CPUQuota = %v, want 1.5", limits.CPUQuota)
+	}
+	if limits.MemoryMax != 536870912 {
+		t.Errorf("MemoryMax = %v, want 536870912", limits.MemoryMax)
+	}
+}
+
+func TestReadLimitsV1Unlimited(t *testing.T) {
+	cpuDir := t.TempDir()
+	memDir := t.TempDir()
+
+	writeFile(t, cpuDir, "cpu.cfs_quota_us", "-1\n")
+	writeFile(t, cpuDir, "cpu.cfs_period_us", "100000\n")
+	writeFile(t, memDir, "memory.limit_in_bytes", "9223372036854771712\n")
+
+	limits, err := readLimitsV1(cpuDir, memDir)
+	if err != nil {
+		t.Fatalf("readLimitsV1: %s", err)
+	}
+
+	if limits.CPUQuota != 0 {
+		t.Errorf("CPUQuota = %v, want 0", limits.CPUQuota)
+	}
+	if limits.MemoryMax != 0 {
+		t.Errorf("MemoryMax = %v, want 0", limits.MemoryMax)
+	}
+}
+
+func TestBudgetMaxUnwindTableRows(t *testing.T) {
+	b := &Budget{memoryLimit: 1 << 30} // 1GiB
+	want := int(float64(b.memoryLimit) * unwindTableBudgetFraction / unwindTableRowSize)
+	if got := b.MaxUnwindTableRows(); got != want {
+		t.Errorf("MaxUnwindTableRows() = %d, want %d", got, want)
+	}
+
+	var nilBudget *Budget
+	if got := nilBudget.MaxUnwindTableRows(); got != 0 {
+		t.Errorf("nil Budget.MaxUnwindTableRows() = %d, want 0", got)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroups
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	observedCPUQuota = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "parca_agent_cgroup_cpu_quota_cores",
+		Help: "CPU quota of the cgroup the agent is running in, in cores. 0 means no quota is set.",
+	})
+	observedMemoryMax = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "parca_agent_cgroup_memory_max_bytes",
+		Help: "Hard memory limit of the cgroup the agent is running in, in bytes. 0 means no limit is set.",
+	})
+	observedMemoryHigh = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "parca_agent_cgroup_memory_high_bytes",
+		Help: "Soft memory limit of the cgroup the agent is running in, in bytes. 0 means no limit is set.",
+	})
+	derivedGOMAXPROCS = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "parca_agent_runtime_gomaxprocs",
+		Help: "The value of GOMAXPROCS the agent derived from its cgroup CPU quota, or from the GOMAXPROCS env var if set.",
+	})
+	derivedGOMEMLIMIT = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "parca_agent_runtime_gomemlimit_bytes",
+		Help: "The soft memory limit the agent derived from its cgroup memory limits, or from the GOMEMLIMIT env var if set, in bytes.",
+	})
+	unwindTableBudgetRows = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "parca_agent_unwind_table_budget_rows",
+		Help: "Maximum number of in-kernel unwind table rows, across every tracked PID, derived from the cgroup memory limit.",
+	})
+	unwindTableRowsInUse = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "parca_agent_unwind_table_rows_in_use",
+		Help: "Number of in-kernel unwind table rows currently populated, across every tracked PID.",
+	})
+	unwindTableEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "parca_agent_unwind_table_evictions_total",
+		Help: "Number of PIDs evicted from the in-kernel unwind tables to stay within the memory budget.",
+	})
+)
+
+// MustRegister registers the cgroup auto-tuning and unwind table budget
+// metrics with reg, panicking if a metric with the same name is already
+// registered.
+func MustRegister(reg prometheus.Registerer) {
+	reg.MustRegister(
+		observedCPUQuota,
+		observedMemoryMax,
+		observedMemoryHigh,
+		derivedGOMAXPROCS,
+		derivedGOMEMLIMIT,
+		unwindTableBudgetRows,
+		unwindTableRowsInUse,
+		unwindTableEvictions,
+	)
+}
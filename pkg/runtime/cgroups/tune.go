@@ -0,0 +1,92 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroups
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+)
+
+// memoryLimitHeadroom is how much of the derived memory limit we actually
+// hand to GOMEMLIMIT, leaving the rest for non-Go memory the Go runtime
+// doesn't account for: mmap'd eBPF maps, cgo allocations, the kernel's own
+// page cache pressure inside the cgroup.
+const memoryLimitHeadroom = 0.9
+
+// Tune sets GOMAXPROCS and the Go runtime's soft memory limit (via
+// runtime/debug.SetMemoryLimit) from the current cgroup's CPU and memory
+// limits, honouring explicit GOMAXPROCS/GOMEMLIMIT environment variable
+// overrides the same way the Go runtime itself does. It returns a Budget
+// the caller can use to size in-kernel data structures relative to the same
+// memory limit.
+func Tune() (*Budget, error) {
+	limits, err := ReadLimits()
+	if err != nil {
+		return nil, fmt.Errorf("read cgroup limits: %w", err)
+	}
+
+	procs := applyGOMAXPROCS(limits)
+	memLimit := applyGOMEMLIMIT(limits)
+
+	observedCPUQuota.Set(limits.CPUQuota)
+	observedMemoryMax.Set(float64(limits.MemoryMax))
+	observedMemoryHigh.Set(float64(limits.MemoryHigh))
+	derivedGOMAXPROCS.Set(float64(procs))
+	derivedGOMEMLIMIT.Set(float64(memLimit))
+
+	b := &Budget{memoryLimit: memLimit}
+	unwindTableBudgetRows.Set(float64(b.MaxUnwindTableRows()))
+	return b, nil
+}
+
+// applyGOMAXPROCS sets GOMAXPROCS from limits.CPUQuota and returns the value
+// in effect afterwards. An explicit GOMAXPROCS environment variable, which
+// the Go runtime already applies before main() runs, takes precedence.
+func applyGOMAXPROCS(limits Limits) int {
+	if v, ok := os.LookupEnv("GOMAXPROCS"); ok && v != "" {
+		return runtime.GOMAXPROCS(0)
+	}
+
+	if limits.CPUQuota <= 0 {
+		return runtime.GOMAXPROCS(0)
+	}
+
+	procs := int(limits.CPUQuota)
+	if procs < 1 {
+		procs = 1
+	}
+	return runtime.GOMAXPROCS(procs)
+}
+
+// applyGOMEMLIMIT sets the Go runtime's soft memory limit from limits and
+// returns the value in effect afterwards. An explicit GOMEMLIMIT
+// environment variable, which the Go runtime already applies before main()
+// runs, takes precedence.
+func applyGOMEMLIMIT(limits Limits) int64 {
+	if v, ok := os.LookupEnv("GOMEMLIMIT"); ok && v != "" {
+		return debug.SetMemoryLimit(-1) // -1 only reads back the current limit.
+	}
+
+	limit := limits.MemoryHigh
+	if limit <= 0 {
+		limit = limits.MemoryMax
+	}
+	if limit <= 0 {
+		return debug.SetMemoryLimit(-1)
+	}
+
+	return debug.SetMemoryLimit(int64(float64(limit) * memoryLimitHeadroom))
+}
@@ -0,0 +1,304 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unwind
+
+// MaxExpressionSteps bounds how many instructions a CompiledExpression may
+// have. The eBPF side executes these in a statically unrolled loop, so the
+// bound has to be small and fixed ahead of time.
+const MaxExpressionSteps = 8
+
+// ExpressionOpcode is the reduced instruction set CompileExpression lowers
+// DWARF location expressions into. It only needs to cover the handful of
+// shapes GCC, LLVM and rustc actually emit for CFA rules: some register
+// arithmetic and, occasionally, a dereference.
+type ExpressionOpcode uint8
+
+const (
+	// ExprOpPushReg pushes the value of DWARF register Operand.
+	ExprOpPushReg ExpressionOpcode = iota
+	// ExprOpPushConst pushes the constant Operand.
+	ExprOpPushConst
+	// ExprOpDeref pops an address and pushes the word stored at it.
+	ExprOpDeref
+	// ExprOpAdd pops b, a and pushes a+b.
+	ExprOpAdd
+	// ExprOpSub pops b, a and pushes a-b.
+	ExprOpSub
+	// ExprOpMul pops b, a and pushes a*b.
+	ExprOpMul
+	// ExprOpAnd pops b, a and pushes a&b.
+	ExprOpAnd
+	// ExprOpOr pops b, a and pushes a|b.
+	ExprOpOr
+	// ExprOpShl pops b, a and pushes a<<b.
+	ExprOpShl
+	// ExprOpShr pops b, a and pushes a>>b.
+	ExprOpShr
+)
+
+// ExpressionStep is a single compiled instruction.
+type ExpressionStep struct {
+	Op      ExpressionOpcode
+	Operand int64
+}
+
+// CompiledExpression is the fixed-size program the BPF unwinder executes as
+// a tiny stack machine in place of the (register, offset) pair used for the
+// common CFA rule.
+type CompiledExpression struct {
+	Steps []ExpressionStep
+}
+
+// The subset of DWARF expression opcodes (DWARF v5, section 2.5.1) that
+// CompileExpression understands.
+const (
+	dwOpAddr       = 0x03
+	dwOpDeref      = 0x06
+	dwOpConst1u    = 0x08
+	dwOpConst1s    = 0x09
+	dwOpConst2u    = 0x0a
+	dwOpConst2s    = 0x0b
+	dwOpConst4u    = 0x0c
+	dwOpConst4s    = 0x0d
+	dwOpConst8u    = 0x0e
+	dwOpConst8s    = 0x0f
+	dwOpConstu     = 0x10
+	dwOpConsts     = 0x11
+	dwOpMinus      = 0x1c
+	dwOpAnd        = 0x1a
+	dwOpPlus       = 0x22
+	dwOpPlusUconst = 0x23
+	dwOpShl        = 0x24
+	dwOpShr        = 0x25
+	dwOpMul        = 0x1e
+	dwOpOr         = 0x21
+	dwOpLit0       = 0x30
+	dwOpLit31      = 0x4f
+	dwOpReg0       = 0x50
+	dwOpReg31      = 0x6f
+	dwOpBreg0      = 0x70
+	dwOpBreg31     = 0x8f
+	dwOpRegx       = 0x90
+	dwOpFbreg      = 0x91
+	dwOpBregx      = 0x92
+)
+
+// CompileExpression lowers a raw DWARF location expression (as stored in a
+// CFA rule produced by the frame unwind-info decoder) into a bounded
+// sequence of ExpressionStep. It pattern-matches the handful of shapes
+// GCC/LLVM/rustc emit for CFA rules: DW_OP_breg*/DW_OP_bregx (register plus
+// signed offset), DW_OP_lit*/DW_OP_const* (immediates), DW_OP_deref and the
+// arithmetic/bitwise operators. Anything else, or a program that doesn't fit
+// in MaxExpressionSteps, is reported via ok=false so the caller can fall
+// back to a conservative unwind rule instead.
+func CompileExpression(raw []byte) (expr CompiledExpression, ok bool) {
+	r := &exprReader{buf: raw}
+	var steps []ExpressionStep
+
+	for r.len() > 0 {
+		if len(steps) >= MaxExpressionSteps {
+			return CompiledExpression{}, false
+		}
+
+		op, ok := r.readByte()
+		if !ok {
+			return CompiledExpression{}, false
+		}
+
+		switch {
+		case op >= dwOpBreg0 && op <= dwOpBreg31:
+			offset, ok := r.readSLEB128()
+			if !ok {
+				return CompiledExpression{}, false
+			}
+			steps = appendRegPlusOffset(steps, int64(op-dwOpBreg0), offset)
+		case op == dwOpBregx:
+			reg, ok1 := r.readULEB128()
+			offset, ok2 := r.readSLEB128()
+			if !ok1 || !ok2 {
+				return CompiledExpression{}, false
+			}
+			steps = appendRegPlusOffset(steps, int64(reg), offset)
+		case op >= dwOpLit0 && op <= dwOpLit31:
+			steps = append(steps, ExpressionStep{Op: ExprOpPushConst, Operand: int64(op - dwOpLit0)})
+		case op == dwOpConst1u || op == dwOpConst1s:
+			v, ok := r.readByte()
+			if !ok {
+				return CompiledExpression{}, false
+			}
+			val := int64(v)
+			if op == dwOpConst1s {
+				val = int64(int8(v))
+			}
+			steps = append(steps, ExpressionStep{Op: ExprOpPushConst, Operand: val})
+		case op == dwOpConst2u || op == dwOpConst2s:
+			v, ok := r.readUint(2)
+			if !ok {
+				return CompiledExpression{}, false
+			}
+			val := int64(v)
+			if op == dwOpConst2s {
+				val = int64(int16(v))
+			}
+			steps = append(steps, ExpressionStep{Op: ExprOpPushConst, Operand: val})
+		case op == dwOpConst4u || op == dwOpConst4s:
+			v, ok := r.readUint(4)
+			if !ok {
+				return CompiledExpression{}, false
+			}
+			val := int64(v)
+			if op == dwOpConst4s {
+				val = int64(int32(v))
+			}
+			steps = append(steps, ExpressionStep{Op: ExprOpPushConst, Operand: val})
+		case op == dwOpConst8u || op == dwOpConst8s:
+			v, ok := r.readUint(8)
+			if !ok {
+				return CompiledExpression{}, false
+			}
+			steps = append(steps, ExpressionStep{Op: ExprOpPushConst, Operand: int64(v)})
+		case op == dwOpConstu:
+			v, ok := r.readULEB128()
+			if !ok {
+				return CompiledExpression{}, false
+			}
+			steps = append(steps, ExpressionStep{Op: ExprOpPushConst, Operand: v})
+		case op == dwOpConsts:
+			v, ok := r.readSLEB128()
+			if !ok {
+				return CompiledExpression{}, false
+			}
+			steps = append(steps, ExpressionStep{Op: ExprOpPushConst, Operand: v})
+		case op == dwOpPlusUconst:
+			v, ok := r.readULEB128()
+			if !ok {
+				return CompiledExpression{}, false
+			}
+			steps = append(steps, ExpressionStep{Op: ExprOpPushConst, Operand: v}, ExpressionStep{Op: ExprOpAdd})
+		case op == dwOpDeref:
+			steps = append(steps, ExpressionStep{Op: ExprOpDeref})
+		case op == dwOpPlus:
+			steps = append(steps, ExpressionStep{Op: ExprOpAdd})
+		case op == dwOpMinus:
+			steps = append(steps, ExpressionStep{Op: ExprOpSub})
+		case op == dwOpMul:
+			steps = append(steps, ExpressionStep{Op: ExprOpMul})
+		case op == dwOpAnd:
+			steps = append(steps, ExpressionStep{Op: ExprOpAnd})
+		case op == dwOpOr:
+			steps = append(steps, ExpressionStep{Op: ExprOpOr})
+		case op == dwOpShl:
+			steps = append(steps, ExpressionStep{Op: ExprOpShl})
+		case op == dwOpShr:
+			steps = append(steps, ExpressionStep{Op: ExprOpShr})
+		default:
+			// Anything else (DW_OP_addr, DW_OP_call_frame_cfa, the
+			// location-description-list opcodes, ...) needs a general
+			// purpose DWARF interpreter we don't have room for in the
+			// unwinder. Bail out rather than silently producing a wrong
+			// answer.
+			return CompiledExpression{}, false
+		}
+
+		if len(steps) > MaxExpressionSteps {
+			return CompiledExpression{}, false
+		}
+	}
+
+	if len(steps) == 0 {
+		return CompiledExpression{}, false
+	}
+
+	return CompiledExpression{Steps: steps}, true
+}
+
+// appendRegPlusOffset compiles "push register; push offset; add" down to a
+// single push when offset is zero, which is by far the common case for CFA
+// rules (DW_OP_bregN 0).
+func appendRegPlusOffset(steps []ExpressionStep, reg, offset int64) []ExpressionStep {
+	steps = append(steps, ExpressionStep{Op: ExprOpPushReg, Operand: reg})
+	if offset != 0 {
+		steps = append(steps, ExpressionStep{Op: ExprOpPushConst, Operand: offset}, ExpressionStep{Op: ExprOpAdd})
+	}
+	return steps
+}
+
+// exprReader is a minimal cursor over a DWARF expression byte stream,
+// supporting the fixed-width and LEB128 operand encodings DW_OP_* uses.
+type exprReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *exprReader) len() int { return len(r.buf) - r.pos }
+
+func (r *exprReader) readByte() (byte, bool) {
+	if r.len() < 1 {
+		return 0, false
+	}
+	b := r.buf[r.pos]
+	r.pos++
+	return b, true
+}
+
+func (r *exprReader) readUint(n int) (uint64, bool) {
+	if r.len() < n {
+		return 0, false
+	}
+	var v uint64
+	for i := 0; i < n; i++ {
+		v |= uint64(r.buf[r.pos+i]) << (8 * i)
+	}
+	r.pos += n
+	return v, true
+}
+
+func (r *exprReader) readULEB128() (int64, bool) {
+	var result uint64
+	var shift uint
+	for {
+		b, ok := r.readByte()
+		if !ok {
+			return 0, false
+		}
+		result |= uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		shift += 7
+	}
+	return int64(result), true
+}
+
+func (r *exprReader) readSLEB128() (int64, bool) {
+	var result int64
+	var shift uint
+	var b byte
+	var ok bool
+	for {
+		b, ok = r.readByte()
+		if !ok {
+			return 0, false
+		}
+		result |= int64(b&0x7f) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	if shift < 64 && b&0x40 != 0 {
+		result |= -1 << shift
+	}
+	return result, true
+}
@@ -0,0 +1,108 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unwind
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ExpressionTable assigns stable ids to CompiledExpressions so that unwind
+// table rows can reference a program in the unwind_expressions BPF map by
+// id instead of embedding it inline.
+type ExpressionTable struct {
+	byKey map[string]uint64
+	byID  []CompiledExpression
+
+	// flushed is the number of leading entries of byID a caller has
+	// already seen via NewSince; see NewSince.
+	flushed int
+}
+
+// NewExpressionTable returns an empty ExpressionTable.
+func NewExpressionTable() *ExpressionTable {
+	return &ExpressionTable{byKey: map[string]uint64{}}
+}
+
+// Add registers expr, returning the id it was assigned. Identical
+// expressions (e.g. the same CFA rule shared by many functions) are
+// deduplicated and reuse the same id.
+func (t *ExpressionTable) Add(expr CompiledExpression) uint64 {
+	key := expressionKey(expr)
+	if id, ok := t.byKey[key]; ok {
+		return id
+	}
+
+	id := uint64(len(t.byID))
+	t.byID = append(t.byID, expr)
+	t.byKey[key] = id
+	return id
+}
+
+// Expressions returns every registered expression, indexed by id.
+func (t *ExpressionTable) Expressions() []CompiledExpression {
+	return t.byID
+}
+
+// NewSince returns the expressions registered since the last call to
+// NewSince, indexed starting at the id of the first one, and advances the
+// table's watermark past them. Callers that upload the table's contents to
+// an external store (e.g. a BPF map) in batches should use this instead of
+// Expressions to avoid re-uploading everything on every flush.
+func (t *ExpressionTable) NewSince() (firstID uint64, exprs []CompiledExpression) {
+	firstID = uint64(t.flushed)
+	exprs = t.byID[t.flushed:]
+	t.flushed = len(t.byID)
+	return firstID, exprs
+}
+
+func expressionKey(expr CompiledExpression) string {
+	var sb strings.Builder
+	for _, s := range expr.Steps {
+		fmt.Fprintf(&sb, "%d:%d;", s.Op, s.Operand)
+	}
+	return sb.String()
+}
+
+// String renders a CompiledExpression in a debugger-friendly form, e.g.
+// "reg(6) + -16 ; deref".
+func (e CompiledExpression) String() string {
+	var parts []string
+	for _, s := range e.Steps {
+		switch s.Op {
+		case ExprOpPushReg:
+			parts = append(parts, "reg("+strconv.FormatInt(s.Operand, 10)+")")
+		case ExprOpPushConst:
+			parts = append(parts, strconv.FormatInt(s.Operand, 10))
+		case ExprOpDeref:
+			parts = append(parts, "deref")
+		case ExprOpAdd:
+			parts = append(parts, "+")
+		case ExprOpSub:
+			parts = append(parts, "-")
+		case ExprOpMul:
+			parts = append(parts, "*")
+		case ExprOpAnd:
+			parts = append(parts, "&")
+		case ExprOpOr:
+			parts = append(parts, "|")
+		case ExprOpShl:
+			parts = append(parts, "<<")
+		case ExprOpShr:
+			parts = append(parts, ">>")
+		}
+	}
+	return strings.Join(parts, " ")
+}
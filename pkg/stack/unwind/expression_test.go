@@ -0,0 +1,182 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unwind
+
+import "testing"
+
+// leb128 encodes v as a signed LEB128, matching how gcc/llvm encode
+// DW_OP_breg*/DW_OP_bregx offsets.
+func sleb128(v int64) []byte {
+	var out []byte
+	more := true
+	for more {
+		b := byte(v & 0x7f)
+		v >>= 7
+		signBitSet := b&0x40 != 0
+		if (v == 0 && !signBitSet) || (v == -1 && signBitSet) {
+			more = false
+		} else {
+			b |= 0x80
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+func uleb128(v uint64) []byte {
+	var out []byte
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if v != 0 {
+			b |= 0x80
+		}
+		out = append(out, b)
+		if v == 0 {
+			break
+		}
+	}
+	return out
+}
+
+func TestCompileExpression_BregPlusOffset(t *testing.T) {
+	// DW_OP_breg6 -16, the shape LLVM commonly emits for the CFA when rbp
+	// has been saved at a fixed offset but isn't itself the CFA register.
+	raw := append([]byte{dwOpBreg0 + 6}, sleb128(-16)...)
+
+	expr, ok := CompileExpression(raw)
+	if !ok {
+		t.Fatalf("expected expression to compile")
+	}
+
+	want := []ExpressionStep{
+		{Op: ExprOpPushReg, Operand: 6},
+		{Op: ExprOpPushConst, Operand: -16},
+		{Op: ExprOpAdd},
+	}
+	assertSteps(t, expr.Steps, want)
+}
+
+func TestCompileExpression_BregZeroOffsetCollapses(t *testing.T) {
+	raw := append([]byte{dwOpBreg0 + 7}, sleb128(0)...)
+
+	expr, ok := CompileExpression(raw)
+	if !ok {
+		t.Fatalf("expected expression to compile")
+	}
+
+	want := []ExpressionStep{{Op: ExprOpPushReg, Operand: 7}}
+	assertSteps(t, expr.Steps, want)
+}
+
+func TestCompileExpression_Bregx(t *testing.T) {
+	// DW_OP_bregx reg=29, offset=8 — seen in Rust panic unwind tables for
+	// architectures with more than 32 DWARF registers.
+	raw := []byte{dwOpBregx}
+	raw = append(raw, uleb128(29)...)
+	raw = append(raw, sleb128(8)...)
+
+	expr, ok := CompileExpression(raw)
+	if !ok {
+		t.Fatalf("expected expression to compile")
+	}
+
+	want := []ExpressionStep{
+		{Op: ExprOpPushReg, Operand: 29},
+		{Op: ExprOpPushConst, Operand: 8},
+		{Op: ExprOpAdd},
+	}
+	assertSteps(t, expr.Steps, want)
+}
+
+func TestCompileExpression_DerefAndPlusUconst(t *testing.T) {
+	// DW_OP_breg6 0; DW_OP_deref; DW_OP_plus_uconst 8 — a signal-frame-style
+	// CFA that reads a saved pointer off the stack and adds a constant.
+	raw := append([]byte{dwOpBreg0 + 6}, sleb128(0)...)
+	raw = append(raw, dwOpDeref)
+	raw = append(raw, dwOpPlusUconst)
+	raw = append(raw, uleb128(8)...)
+
+	expr, ok := CompileExpression(raw)
+	if !ok {
+		t.Fatalf("expected expression to compile")
+	}
+
+	want := []ExpressionStep{
+		{Op: ExprOpPushReg, Operand: 6},
+		{Op: ExprOpDeref},
+		{Op: ExprOpPushConst, Operand: 8},
+		{Op: ExprOpAdd},
+	}
+	assertSteps(t, expr.Steps, want)
+}
+
+func TestCompileExpression_UnsupportedOpcode(t *testing.T) {
+	// DW_OP_addr takes an architecture-sized absolute address; we don't
+	// support it since a CFA rule built on it is nonsensical.
+	raw := []byte{dwOpAddr, 0, 0, 0, 0, 0, 0, 0, 0}
+
+	if _, ok := CompileExpression(raw); ok {
+		t.Fatalf("expected unsupported opcode to fail to compile")
+	}
+}
+
+func TestCompileExpression_TooManySteps(t *testing.T) {
+	var raw []byte
+	for i := 0; i < MaxExpressionSteps+1; i++ {
+		raw = append(raw, dwOpLit0)
+	}
+
+	if _, ok := CompileExpression(raw); ok {
+		t.Fatalf("expected overlong expression to fail to compile")
+	}
+}
+
+func TestExpressionTable_Dedup(t *testing.T) {
+	raw := append([]byte{dwOpBreg0 + 6}, sleb128(-16)...)
+	expr, ok := CompileExpression(raw)
+	if !ok {
+		t.Fatalf("expected expression to compile")
+	}
+
+	table := NewExpressionTable()
+	id1 := table.Add(expr)
+	id2 := table.Add(expr)
+	if id1 != id2 {
+		t.Fatalf("expected identical expressions to share an id, got %d and %d", id1, id2)
+	}
+
+	other := CompiledExpression{Steps: []ExpressionStep{{Op: ExprOpPushReg, Operand: 3}}}
+	id3 := table.Add(other)
+	if id3 == id1 {
+		t.Fatalf("expected distinct expressions to get distinct ids")
+	}
+
+	if len(table.Expressions()) != 2 {
+		t.Fatalf("expected 2 registered expressions, got %d", len(table.Expressions()))
+	}
+}
+
+func assertSteps(t *testing.T, got, want []ExpressionStep) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Fatalf("step count mismatch: got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("step %d mismatch: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}